@@ -0,0 +1,141 @@
+package checkpoint
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+
+	"github.com/elastic/beats/libbeat/logp"
+	"go.etcd.io/bbolt"
+)
+
+// eventLogBucket is the name of the bbolt bucket that holds one key per
+// event log, keyed by log name, with the value being a gob-encoded
+// EventLogState.
+var eventLogBucket = []byte("event_logs")
+
+// BoltStore is a Store implementation backed by an embedded bbolt
+// key-value database. Unlike YAMLStore it does not need to rewrite the
+// full state on every update -- Batch writes are applied as a single ACID
+// transaction keyed by log name.
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+// NewBoltStore opens (creating if necessary) a bbolt database at file and
+// returns a Store backed by it. If legacyYAMLFile is non-empty and the bbolt
+// database has no event log state yet, the legacy YAML file is imported as a
+// one-shot migration.
+func NewBoltStore(file string, legacyYAMLFile string) (*BoltStore, error) {
+	db, err := bbolt.Open(file, 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint database %v: %v", file, err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(eventLogBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize checkpoint database %v: %v", file, err)
+	}
+
+	s := &BoltStore{db: db}
+
+	if legacyYAMLFile != "" {
+		if err = s.migrateFromYAML(legacyYAMLFile); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// migrateFromYAML imports the legacy YAML checkpoint file into the bbolt
+// database. It is a no-op if the database already contains event log state
+// or the legacy file does not exist.
+func (s *BoltStore) migrateFromYAML(legacyYAMLFile string) error {
+	existing, err := s.Load()
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return nil
+	}
+
+	yamlStore, err := NewYAMLStore(legacyYAMLFile)
+	if err != nil {
+		return err
+	}
+
+	legacy, err := yamlStore.Load()
+	if err != nil {
+		return err
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+
+	states := make([]EventLogState, 0, len(legacy))
+	for _, state := range legacy {
+		states = append(states, state)
+	}
+
+	if err = s.Batch(states); err != nil {
+		return err
+	}
+
+	logp.Info("checkpoint: migrated %d event log states from legacy YAML file %v",
+		len(states), legacyYAMLFile)
+	return nil
+}
+
+// Load returns all event log state stored in the database.
+func (s *BoltStore) Load() (map[string]EventLogState, error) {
+	states := make(map[string]EventLogState)
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(eventLogBucket)
+		return b.ForEach(func(k, v []byte) error {
+			var state EventLogState
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&state); err != nil {
+				return fmt.Errorf("failed to decode checkpoint state for %v: %v", string(k), err)
+			}
+			states[state.Name] = state
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// Save persists a single EventLogState in its own transaction.
+func (s *BoltStore) Save(state EventLogState) error {
+	return s.Batch([]EventLogState{state})
+}
+
+// Batch writes all of the given states in a single bbolt transaction.
+func (s *BoltStore) Batch(states []EventLogState) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(eventLogBucket)
+		for _, state := range states {
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+				return fmt.Errorf("failed to encode checkpoint state for %v: %v", state.Name, err)
+			}
+			if err := b.Put([]byte(state.Name), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close closes the underlying bbolt database.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,56 @@
+package checkpoint
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoltStoreMigrateFromYAML(t *testing.T) {
+	dir := t.TempDir()
+	yamlFile := filepath.Join(dir, "legacy.yml")
+	boltFile := filepath.Join(dir, "checkpoint.db")
+
+	yamlStore, err := NewYAMLStore(yamlFile)
+	require.NoError(t, err)
+	legacy := EventLogState{Name: "Application", RecordNumber: 42, Timestamp: time.Now().UTC()}
+	require.NoError(t, yamlStore.Save(legacy))
+
+	store, err := NewBoltStore(boltFile, yamlFile)
+	require.NoError(t, err)
+	defer store.Close()
+
+	states, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]EventLogState{legacy.Name: legacy}, states)
+
+	// Reopening with the same legacy file must not re-import (and therefore
+	// not duplicate or clobber newer state already recorded in bolt).
+	newer := EventLogState{Name: legacy.Name, RecordNumber: 100, Timestamp: time.Now().UTC()}
+	require.NoError(t, store.Save(newer))
+	require.NoError(t, store.Close())
+
+	store2, err := NewBoltStore(boltFile, yamlFile)
+	require.NoError(t, err)
+	defer store2.Close()
+
+	states, err = store2.Load()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]EventLogState{newer.Name: newer}, states)
+}
+
+func TestBoltStoreMigrateFromYAMLNoLegacyFile(t *testing.T) {
+	dir := t.TempDir()
+	boltFile := filepath.Join(dir, "checkpoint.db")
+
+	store, err := NewBoltStore(boltFile, filepath.Join(dir, "does-not-exist.yml"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	states, err := store.Load()
+	require.NoError(t, err)
+	assert.Empty(t, states)
+}
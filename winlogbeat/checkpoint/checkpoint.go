@@ -4,39 +4,37 @@
 package checkpoint
 
 import (
-	"fmt"
-	"os"
-	"sort"
+	"context"
+	"math/rand"
 	"sync"
 	"time"
 
-	"io/ioutil"
-
 	"github.com/elastic/beats/libbeat/logp"
-	"gopkg.in/yaml.v2"
 )
 
-// Checkpoint persists event log state information to disk.
+// Checkpoint persists event log state information using a pluggable Store.
 type Checkpoint struct {
-	wg            sync.WaitGroup // WaitGroup used to wait on the shutdown of the checkpoint worker.
-	done          chan struct{}  // Channel for shutting down the checkpoint worker.
-	once          sync.Once      // Used to guarantee shutdown happens once.
-	file          string         // File where the state is persisted.
-	numUpdates    int            // Number of updates received since last persisting to disk.
-	maxUpdates    int            // Maximum number of updates to buffer before persisting to disk.
-	flushInterval time.Duration  // Maximum time interval that can pass before persisting to disk.
-	sort          []string       // Slice used for sorting states map (store to save on mallocs).
+	wg    sync.WaitGroup // WaitGroup used to wait on the shutdown of the checkpoint worker.
+	done  chan struct{}  // Channel for shutting down the checkpoint worker.
+	once  sync.Once      // Used to guarantee shutdown happens once.
+	store Store          // Backend that the state is persisted to.
+
+	numUpdates    int           // Number of updates received since last persisting to disk.
+	maxUpdates    int           // Maximum number of updates to buffer before persisting to disk.
+	flushInterval time.Duration // Maximum time interval that can pass before persisting to disk.
+	flushJitter   time.Duration // Random jitter added to flushInterval to avoid thundering-herd fsyncs.
 
 	lock   sync.RWMutex
 	states map[string]EventLogState
 
 	save chan EventLogState
-}
 
-// PersistedState represents the format of the data persisted to disk.
-type PersistedState struct {
-	UpdateTime time.Time       `yaml:"update_time"`
-	States     []EventLogState `yaml:"event_logs"`
+	// leaseAcquired is non-nil when store implements LeaseNotifier. It
+	// delivers the latest persisted state for a channel whenever this
+	// instance newly takes over that channel's harvesting lease, so
+	// resumption continues from the previous owner's RecordNumber instead
+	// of whatever was last known locally.
+	leaseAcquired <-chan EventLogState
 }
 
 // EventLogState represents the state of an individual event log.
@@ -46,47 +44,62 @@ type EventLogState struct {
 	Timestamp    time.Time `yaml:"timestamp"`
 }
 
-// NewCheckpoint creates and returns a new Checkpoint. This method loads state
-// information from disk if it exists and starts a goroutine for persisting
-// state information to disk. Shutdown should be called when finished to
-// guarantee any in-memory state information is flushed to disk.
-//
-// file is the name of the file where event log state is persisted as YAML.
-// maxUpdates is the maximum number of updates checkpoint will accept before
-// triggering a flush to disk. interval is maximum amount of time that can
-// pass since the last flush before triggering a flush to disk (minimum value
-// is 1s).
-func NewCheckpoint(file string, maxUpdates int, interval time.Duration) (*Checkpoint, error) {
-	c := &Checkpoint{
-		done:          make(chan struct{}),
-		file:          file,
-		maxUpdates:    maxUpdates,
-		flushInterval: interval,
-		sort:          make([]string, 0, 10),
-		states:        make(map[string]EventLogState),
-		save:          make(chan EventLogState, 1),
-	}
+// Config controls the buffering, flush cadence, and backpressure behavior of
+// a Checkpoint. The zero value is valid and is replaced with sane minimums
+// by NewCheckpoint.
+type Config struct {
+	// MaxUpdates is the maximum number of updates checkpoint will accept
+	// before triggering a flush to the store.
+	MaxUpdates int
+	// FlushInterval is the maximum amount of time that can pass since the
+	// last flush before triggering a flush to the store (minimum value is
+	// 1s).
+	FlushInterval time.Duration
+	// FlushJitter adds a random duration in [0, FlushJitter) to each
+	// FlushInterval so that many event logs configured with the same
+	// interval do not flush in lockstep.
+	FlushJitter time.Duration
+	// QueueSize is the capacity of the internal channel used to buffer
+	// updates between Persist and the checkpoint worker. Once full,
+	// Persist no longer blocks -- it reports that the update was dropped.
+	// PersistContext waits for room until its context is done.
+	QueueSize int
+}
 
-	// Minimum batch size.
-	if c.maxUpdates < 1 {
-		c.maxUpdates = 1
+// NewCheckpoint creates and returns a new Checkpoint backed by store. This
+// method loads any state already present in store and starts a goroutine
+// for persisting state information to it. Shutdown should be called when
+// finished to guarantee any in-memory state information is flushed.
+func NewCheckpoint(store Store, cfg Config) (*Checkpoint, error) {
+	if cfg.MaxUpdates < 1 {
+		cfg.MaxUpdates = 1
+	}
+	if cfg.FlushInterval < time.Second {
+		cfg.FlushInterval = time.Second
+	}
+	if cfg.QueueSize < 1 {
+		cfg.QueueSize = 1
 	}
 
-	// Minimum flush interval.
-	if c.flushInterval < time.Second {
-		c.flushInterval = time.Second
+	c := &Checkpoint{
+		done:          make(chan struct{}),
+		store:         store,
+		maxUpdates:    cfg.MaxUpdates,
+		flushInterval: cfg.FlushInterval,
+		flushJitter:   cfg.FlushJitter,
+		states:        make(map[string]EventLogState),
+		save:          make(chan EventLogState, cfg.QueueSize),
 	}
 
 	// Read existing state information:
-	ps, err := c.read()
+	states, err := c.store.Load()
 	if err != nil {
 		return nil, err
 	}
+	c.states = states
 
-	if ps != nil {
-		for _, state := range ps.States {
-			c.states[state.Name] = state
-		}
+	if notifier, ok := store.(LeaseNotifier); ok {
+		c.leaseAcquired = notifier.Acquired()
 	}
 
 	c.wg.Add(1)
@@ -94,16 +107,27 @@ func NewCheckpoint(file string, maxUpdates int, interval time.Duration) (*Checkp
 	return c, nil
 }
 
+// nextFlushInterval returns flushInterval plus a random jitter in
+// [0, flushJitter).
+func (c *Checkpoint) nextFlushInterval() time.Duration {
+	if c.flushJitter <= 0 {
+		return c.flushInterval
+	}
+	return c.flushInterval + time.Duration(rand.Int63n(int64(c.flushJitter)))
+}
+
 // run is worker loop that reads incoming state information from the save
-// channel and persists it when the number of changes reaches maxEvents or
+// channel and persists it when the number of changes reaches maxUpdates or
 // the amount of time since the last disk write reaches flushInterval.
 func (c *Checkpoint) run() {
 	defer c.wg.Done()
 
-	flushTimer := time.NewTimer(c.flushInterval)
+	flushTimer := time.NewTimer(c.nextFlushInterval())
 	defer flushTimer.Stop()
 loop:
 	for {
+		queueLen.Set(int64(len(c.save)))
+
 		select {
 		case <-c.done:
 			break loop
@@ -115,28 +139,38 @@ loop:
 			if c.numUpdates < c.maxUpdates {
 				continue
 			}
+		case s := <-c.leaseAcquired:
+			logp.Info("checkpoint: refreshing state for %v after taking over its harvesting lease", s.Name)
+			c.lock.Lock()
+			c.states[s.Name] = s
+			c.lock.Unlock()
+			continue
 		case <-flushTimer.C:
 		}
 
 		c.persist()
-		flushTimer.Reset(c.flushInterval)
+		flushTimer.Reset(c.nextFlushInterval())
 	}
 
 	c.persist()
 }
 
 // Shutdown stops the checkpoint worker (which persists any state to disk as
-// it stops). This method blocks until the checkpoint worker shutdowns. Calling
-// this method more once is safe and has no effect.
+// it stops) and closes the underlying Store. This method blocks until the
+// checkpoint worker shutdowns. Calling this method more once is safe and has
+// no effect.
 func (c *Checkpoint) Shutdown() {
 	c.once.Do(func() {
 		close(c.done)
 		c.wg.Wait()
+		if err := c.store.Close(); err != nil {
+			logp.Err("Failed to close checkpoint store. %v", err)
+		}
 	})
 }
 
 // States returns the current in-memory event log state. This state information
-// is bootstrapped with any data found on disk at creation time.
+// is bootstrapped with any data found in the store at creation time.
 func (c *Checkpoint) States() map[string]EventLogState {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
@@ -149,92 +183,98 @@ func (c *Checkpoint) States() map[string]EventLogState {
 	return copy
 }
 
-// Persist queues the given event log state information to be written to disk.
-func (c *Checkpoint) Persist(name string, recordNumber uint32, ts time.Time) {
-	c.save <- EventLogState{
-		Name:         name,
-		RecordNumber: recordNumber,
-		Timestamp:    ts,
+// Persist queues the given event log state information to be written to the
+// store. It returns false without blocking if the internal queue is full --
+// callers should treat this as a signal that the checkpoint worker is
+// stalled (slow or full disk, unreachable store) and back off rather than
+// lose readings silently.
+func (c *Checkpoint) Persist(name string, recordNumber uint32, ts time.Time) bool {
+	updatesReceived.Inc()
+	select {
+	case c.save <- EventLogState{Name: name, RecordNumber: recordNumber, Timestamp: ts}:
+		return true
+	default:
+		updatesDropped.Inc()
+		logp.Warn("checkpoint: queue is full, dropping update for %v", name)
+		return false
+	}
+}
+
+// PersistContext behaves like Persist but blocks until the update is
+// accepted or ctx is done, whichever happens first. It returns ctx.Err() if
+// ctx is canceled before the update could be queued.
+func (c *Checkpoint) PersistContext(ctx context.Context, name string, recordNumber uint32, ts time.Time) error {
+	updatesReceived.Inc()
+	select {
+	case c.save <- EventLogState{Name: name, RecordNumber: recordNumber, Timestamp: ts}:
+		return nil
+	case <-ctx.Done():
+		updatesDropped.Inc()
+		return ctx.Err()
 	}
 }
 
-// persist writes the current state to disk if the in-memory state is dirty.
+// persist writes the current state to the store if the in-memory state is
+// dirty, retrying transient failures with exponential backoff. The
+// in-memory state is never cleared on failure, so the next flush attempt
+// (whether retried here or triggered by a later update) includes everything
+// accumulated since the last successful write.
 func (c *Checkpoint) persist() bool {
 	if c.numUpdates == 0 {
 		return false
 	}
 
-	err := c.flush()
+	c.lock.RLock()
+	states := make([]EventLogState, 0, len(c.states))
+	for _, s := range c.states {
+		states = append(states, s)
+	}
+	c.lock.RUnlock()
+
+	start := time.Now()
+	err := c.flushWithRetry(states)
+	lastFlushDurationMS.Set(time.Since(start).Nanoseconds() / int64(time.Millisecond))
+
 	if err != nil {
-		logp.Err("%v", err)
+		flushesFailed.Inc()
+		logp.Err("Failed to flush state to checkpoint store after retries. %v", err)
 		return false
 	}
 
-	logp.Debug("checkpoint", "Checkpoint saved to disk. numUpdates=%d",
-		c.numUpdates)
+	flushesOK.Inc()
+	logp.Debug("checkpoint", "Checkpoint saved. numUpdates=%d", c.numUpdates)
 	c.numUpdates = 0
 	return true
 }
 
-// flush writes the current state to disk.
-func (c *Checkpoint) flush() error {
-	tempFile := c.file + ".new"
-	file, err := os.Create(tempFile)
-	if err != nil {
-		return fmt.Errorf("Failed to flush state to disk. Could not open %s. %v",
-			tempFile, err)
-	}
-
-	// Sort persisted eventLogs by name.
-	c.sort = c.sort[:0]
-	for k := range c.states {
-		c.sort = append(c.sort, k)
-	}
-	sort.Strings(c.sort)
-
-	ps := PersistedState{
-		UpdateTime: time.Now().UTC(),
-		States:     make([]EventLogState, len(c.sort)),
-	}
-	for i, name := range c.sort {
-		ps.States[i] = c.states[name]
-	}
-
-	data, err := yaml.Marshal(ps)
-	if err != nil {
-		file.Close()
-		return fmt.Errorf("Failed to flush state to disk. Could not marshal "+
-			"data to YAML. %v", err)
-	}
-
-	_, err = file.Write(data)
-	if err != nil {
-		file.Close()
-		return fmt.Errorf("Failed to flush state to disk. Could not write to "+
-			"%s. %v", tempFile, err)
-	}
+// flushRetryLimit bounds the number of attempts made by flushWithRetry so a
+// persistently broken store (e.g. a disk that never recovers) cannot wedge
+// the worker loop forever; the next scheduled flush will simply try again.
+const flushRetryLimit = 5
+
+// flushWithRetry calls store.Batch, retrying retryable failures (I/O errors
+// such as a full disk or a transient store outage) with exponential
+// backoff.
+func (c *Checkpoint) flushWithRetry(states []EventLogState) error {
+	backoff := 100 * time.Millisecond
+	var err error
+	for attempt := 0; attempt < flushRetryLimit; attempt++ {
+		if err = c.store.Batch(states); err == nil {
+			return nil
+		}
+		if attempt+1 == flushRetryLimit {
+			break
+		}
 
-	file.Close()
-	err = os.Rename(tempFile, c.file)
-	return err
-}
+		logp.Warn("checkpoint: flush attempt %d/%d failed, retrying in %v: %v",
+			attempt+1, flushRetryLimit, backoff, err)
 
-// read loads the persisted state from disk. If the file does not exists then
-// the method returns nil and no error.
-func (c *Checkpoint) read() (*PersistedState, error) {
-	contents, err := ioutil.ReadFile(c.file)
-	if err != nil {
-		if os.IsNotExist(err) {
-			err = nil
+		select {
+		case <-c.done:
+			return err
+		case <-time.After(backoff):
 		}
-		return nil, err
+		backoff *= 2
 	}
-
-	ps := &PersistedState{}
-	err = yaml.Unmarshal(contents, ps)
-	if err != nil {
-		return nil, err
-	}
-
-	return ps, nil
+	return err
 }
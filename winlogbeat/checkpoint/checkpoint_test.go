@@ -0,0 +1,124 @@
+package checkpoint
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStore is a Store test double whose Batch call fails the first
+// failures times it is called and succeeds afterward, recording every
+// batch that was actually persisted.
+type fakeStore struct {
+	mu       sync.Mutex
+	failures int
+	calls    int
+	batches  [][]EventLogState
+}
+
+func (s *fakeStore) Load() (map[string]EventLogState, error) {
+	return make(map[string]EventLogState), nil
+}
+
+func (s *fakeStore) Save(state EventLogState) error {
+	return s.Batch([]EventLogState{state})
+}
+
+func (s *fakeStore) Batch(states []EventLogState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls++
+	if s.calls <= s.failures {
+		return errors.New("simulated disk full")
+	}
+	s.batches = append(s.batches, states)
+	return nil
+}
+
+func (s *fakeStore) Close() error { return nil }
+
+func (s *fakeStore) callCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+// newTestCheckpoint builds a Checkpoint directly (rather than through
+// NewCheckpoint) so tests can drive Persist/persist without the run()
+// worker goroutine racing with assertions.
+func newTestCheckpoint(store Store, queueSize int) *Checkpoint {
+	return &Checkpoint{
+		done:   make(chan struct{}),
+		store:  store,
+		states: make(map[string]EventLogState),
+		save:   make(chan EventLogState, queueSize),
+	}
+}
+
+func TestPersistDropsUpdateWhenQueueIsFull(t *testing.T) {
+	c := newTestCheckpoint(&fakeStore{}, 1)
+
+	droppedBefore := updatesDropped.Get()
+
+	assert.True(t, c.Persist("Application", 1, time.Now()), "first update should fit in the queue")
+	assert.False(t, c.Persist("Application", 2, time.Now()), "second update should be dropped, not block")
+
+	assert.Equal(t, droppedBefore+1, updatesDropped.Get())
+}
+
+func TestPersistContextReturnsErrorWhenCanceled(t *testing.T) {
+	c := newTestCheckpoint(&fakeStore{}, 1)
+	require.True(t, c.Persist("Application", 1, time.Now()), "fill the queue")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := c.PersistContext(ctx, "Application", 2, time.Now())
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestPersistWithContextSucceedsWhenQueueHasRoom(t *testing.T) {
+	c := newTestCheckpoint(&fakeStore{}, 1)
+
+	err := c.PersistContext(context.Background(), "Application", 1, time.Now())
+	assert.NoError(t, err)
+}
+
+func TestFlushWithRetryRetriesTransientFailures(t *testing.T) {
+	store := &fakeStore{failures: 2}
+	c := newTestCheckpoint(store, 1)
+
+	c.states["Application"] = EventLogState{Name: "Application", RecordNumber: 7}
+	c.numUpdates = 1
+
+	okBefore := flushesOK.Get()
+	assert.True(t, c.persist())
+	assert.Equal(t, okBefore+1, flushesOK.Get())
+	assert.Equal(t, 3, store.callCount(), "should have failed twice before succeeding on the third attempt")
+	assert.Equal(t, 0, c.numUpdates)
+	require.Len(t, store.batches, 1)
+	assert.Equal(t, uint32(7), store.batches[0][0].RecordNumber)
+}
+
+func TestPersistRetainsStateOnPersistentFailure(t *testing.T) {
+	store := &fakeStore{failures: flushRetryLimit + 1}
+	c := newTestCheckpoint(store, 1)
+
+	c.states["Application"] = EventLogState{Name: "Application", RecordNumber: 9}
+	c.numUpdates = 1
+
+	failedBefore := flushesFailed.Get()
+	assert.False(t, c.persist())
+	assert.Equal(t, failedBefore+1, flushesFailed.Get())
+
+	// The failed flush must not have cleared the dirty counter or dropped
+	// the in-memory state -- the next flush attempt needs to include it.
+	assert.Equal(t, 1, c.numUpdates)
+	assert.Equal(t, uint32(9), c.states["Application"].RecordNumber)
+}
@@ -0,0 +1,14 @@
+package checkpoint
+
+import "github.com/elastic/beats/libbeat/monitoring"
+
+var checkpointMetrics = monitoring.Default.NewRegistry("winlogbeat.checkpoint")
+
+var (
+	updatesReceived     = monitoring.NewInt(checkpointMetrics, "updates_received")
+	updatesDropped      = monitoring.NewInt(checkpointMetrics, "updates_dropped")
+	flushesOK           = monitoring.NewInt(checkpointMetrics, "flushes_ok")
+	flushesFailed       = monitoring.NewInt(checkpointMetrics, "flushes_failed")
+	lastFlushDurationMS = monitoring.NewInt(checkpointMetrics, "last_flush_duration_ms")
+	queueLen            = monitoring.NewInt(checkpointMetrics, "queue_len")
+)
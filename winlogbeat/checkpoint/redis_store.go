@@ -0,0 +1,398 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/libbeat/monitoring"
+)
+
+// RedisConfig configures a RedisStore.
+type RedisConfig struct {
+	Addrs         []string      `config:"hosts"`                // Redis address(es), host:port; only the first is used.
+	Password      string        `config:"password"`             // Redis AUTH password, if any.
+	DB            int           `config:"db"`                   // Redis logical database.
+	BeatID        string        `config:"beat_id"`              // Identifier for this Winlogbeat instance, used in the lease key.
+	LeaseTTL      time.Duration `config:"lease_ttl"`            // How long a held lease is valid for without renewal.
+	RenewInterval time.Duration `config:"lease_renew_interval"` // How often the lease holder renews its lease.
+	PollInterval  time.Duration `config:"lease_poll_interval"`  // How often a standby instance checks whether the lease is free.
+}
+
+// defaults for RedisConfig fields that are not set.
+const (
+	defaultLeaseTTL      = 30 * time.Second
+	defaultRenewInterval = 10 * time.Second
+	defaultPollInterval  = 5 * time.Second
+)
+
+var redisMetrics = monitoring.Default.NewRegistry("winlogbeat.checkpoint.redis")
+
+var (
+	// leaseHeldCount is the number of channels for which this instance
+	// currently holds the harvesting lease. Unlike a single shared flag,
+	// this stays correct when more than one channel is configured.
+	leaseHeldCount = monitoring.NewInt(redisMetrics, "lease_held_count")
+	// leaseLost counts involuntary lease losses (renewal raced by another
+	// instance) -- the signal operators should alert on.
+	leaseLost = monitoring.NewInt(redisMetrics, "lease_lost_total")
+	// leaseReleased counts voluntary releases (graceful Close), which are
+	// expected on every rolling restart and must not be conflated with
+	// leaseLost.
+	leaseReleased = monitoring.NewInt(redisMetrics, "lease_released_total")
+)
+
+// renewLuaScript atomically extends the lease TTL only if it is still owned
+// by the caller (ARGV[1]), so a lease that this instance believes it holds
+// but that has actually expired and been taken over by a standby is never
+// stomped back to this instance. Returns 1 if the lease was extended, 0 if
+// the caller no longer (or never) owned it.
+const renewLuaScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+else
+	return 0
+end
+`
+
+// redisClient is the subset of a Redis client that RedisStore needs. It
+// exists so tests can exercise the lease state machine (tick,
+// tryAcquireOrRenew, releaseAll) against a fake instead of a live Redis
+// server.
+type redisClient interface {
+	Ping() error
+	SetNX(key, value string, ttl time.Duration) (bool, error)
+	Del(key string) error
+	HGetAll(key string) (map[string]string, error)
+	HGet(key, field string) (value string, ok bool, err error)
+	HSet(key, field, value string) error
+	Eval(script string, keys []string, args ...interface{}) (int64, error)
+	Close() error
+}
+
+// goRedisClient adapts a *redis.Client to the redisClient interface.
+type goRedisClient struct {
+	c *redis.Client
+}
+
+func (g *goRedisClient) Ping() error { return g.c.Ping().Err() }
+
+func (g *goRedisClient) SetNX(key, value string, ttl time.Duration) (bool, error) {
+	return g.c.SetNX(key, value, ttl).Result()
+}
+
+func (g *goRedisClient) Del(key string) error { return g.c.Del(key).Err() }
+
+func (g *goRedisClient) HGetAll(key string) (map[string]string, error) {
+	return g.c.HGetAll(key).Result()
+}
+
+func (g *goRedisClient) HGet(key, field string) (string, bool, error) {
+	value, err := g.c.HGet(key, field).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+func (g *goRedisClient) HSet(key, field, value string) error {
+	return g.c.HSet(key, field, value).Err()
+}
+
+func (g *goRedisClient) Eval(script string, keys []string, args ...interface{}) (int64, error) {
+	result, err := g.c.Eval(script, keys, args...).Result()
+	if err != nil {
+		return 0, err
+	}
+	n, ok := result.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected redis EVAL result type %T", result)
+	}
+	return n, nil
+}
+
+func (g *goRedisClient) Close() error { return g.c.Close() }
+
+// RedisStore is a Store implementation that shares EventLogState across
+// multiple Winlogbeat instances collecting from the same Windows Event Log
+// source (such as nodes of a Windows failover cluster). Only the instance
+// holding the lease for a given channel actively harvests it; standbys poll
+// the lease and take over on expiry, resuming from the last persisted
+// RecordNumber via the Acquired notification (see LeaseNotifier).
+type RedisStore struct {
+	client    redisClient
+	cfg       RedisConfig
+	keyPrefix string // e.g. "winlogbeat:checkpoint:<beat-id>"
+
+	wg   sync.WaitGroup
+	done chan struct{}
+	once sync.Once
+
+	lock   sync.RWMutex
+	leases map[string]bool // channel name -> whether this instance currently holds the lease.
+
+	acquired chan EventLogState
+}
+
+// NewRedisStore creates a Store backed by Redis and starts the background
+// goroutine that renews or polls leases for the configured channels.
+func NewRedisStore(cfg RedisConfig, channels []string) (*RedisStore, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     firstOrEmpty(cfg.Addrs),
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+
+	return newRedisStore(cfg, channels, &goRedisClient{c: client})
+}
+
+// newRedisStore builds a RedisStore around an arbitrary redisClient,
+// allowing tests to inject a fake.
+func newRedisStore(cfg RedisConfig, channels []string, client redisClient) (*RedisStore, error) {
+	if cfg.LeaseTTL <= 0 {
+		cfg.LeaseTTL = defaultLeaseTTL
+	}
+	if cfg.RenewInterval <= 0 {
+		cfg.RenewInterval = defaultRenewInterval
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
+
+	if err := client.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to connect to redis checkpoint store: %v", err)
+	}
+
+	s := &RedisStore{
+		client:    client,
+		cfg:       cfg,
+		keyPrefix: fmt.Sprintf("winlogbeat:checkpoint:%s", cfg.BeatID),
+		done:      make(chan struct{}),
+		leases:    make(map[string]bool),
+		acquired:  make(chan EventLogState, len(channels)),
+	}
+
+	for _, channel := range channels {
+		s.leases[channel] = false
+	}
+
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// Acquired implements LeaseNotifier. It delivers the latest persisted state
+// for a channel whenever this instance newly takes over that channel's
+// harvesting lease.
+func (s *RedisStore) Acquired() <-chan EventLogState {
+	return s.acquired
+}
+
+// run drives lease acquisition and renewal for each configured channel,
+// reporting lease state changes via logp and metrics. Channels this
+// instance already holds are renewed on RenewInterval; channels it does not
+// hold are polled for availability on PollInterval, so a slow PollInterval
+// does not delay renewal of leases already held, and vice versa.
+func (s *RedisStore) run() {
+	defer s.wg.Done()
+
+	renewTicker := time.NewTicker(s.cfg.RenewInterval)
+	defer renewTicker.Stop()
+	pollTicker := time.NewTicker(s.cfg.PollInterval)
+	defer pollTicker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			s.releaseAll()
+			return
+		case <-renewTicker.C:
+			s.tick(true)
+		case <-pollTicker.C:
+			s.tick(false)
+		}
+	}
+}
+
+// tick attempts to acquire or renew the lease for every channel whose
+// current local held state matches forHeld.
+func (s *RedisStore) tick(forHeld bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for channel, held := range s.leases {
+		if held != forHeld {
+			continue
+		}
+		s.leases[channel] = s.tryAcquireOrRenew(channel, held)
+	}
+}
+
+// tryAcquireOrRenew attempts to take over (or renew) the lease for channel
+// and returns whether this instance holds it afterward. Callers must hold
+// s.lock.
+func (s *RedisStore) tryAcquireOrRenew(channel string, held bool) bool {
+	key := s.leaseKey(channel)
+
+	if held {
+		extended, err := s.client.Eval(renewLuaScript, []string{key}, s.cfg.BeatID, int64(s.cfg.LeaseTTL/time.Millisecond))
+		if err != nil {
+			logp.Err("checkpoint: failed to renew redis lease for %v: %v", channel, err)
+			leaseHeldCount.Dec()
+			return false
+		}
+		if extended == 0 {
+			logp.Warn("checkpoint: lost redis lease for channel %v; another instance now owns it", channel)
+			leaseHeldCount.Dec()
+			leaseLost.Inc()
+			return false
+		}
+		return true
+	}
+
+	acquired, err := s.client.SetNX(key, s.cfg.BeatID, s.cfg.LeaseTTL)
+	if err != nil {
+		logp.Err("checkpoint: failed to acquire redis lease for %v: %v", channel, err)
+		return false
+	}
+
+	if acquired {
+		logp.Info("checkpoint: acquired redis lease for channel %v", channel)
+		leaseHeldCount.Inc()
+		s.notifyAcquired(channel)
+	}
+	return acquired
+}
+
+// notifyAcquired loads channel's latest persisted state and publishes it on
+// s.acquired so Checkpoint resumes from the value the previous owner last
+// persisted rather than from whatever it last knew locally.
+func (s *RedisStore) notifyAcquired(channel string) {
+	value, ok, err := s.client.HGet(s.hashKey(), channel)
+	if err != nil {
+		logp.Err("checkpoint: failed to load persisted state for %v after acquiring its lease: %v", channel, err)
+		return
+	}
+	if !ok {
+		// No prior persisted state for this channel -- nothing to resume from.
+		return
+	}
+
+	var state EventLogState
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		logp.Err("checkpoint: failed to decode persisted state for %v after acquiring its lease: %v", channel, err)
+		return
+	}
+
+	select {
+	case s.acquired <- state:
+	default:
+		logp.Warn("checkpoint: acquired-lease notification queue full, %v will resume from its locally-known state", channel)
+	}
+}
+
+// releaseAll gives up any leases held by this instance so another standby
+// can take over promptly instead of waiting for TTL expiry. This is a
+// voluntary release (graceful shutdown) and is tracked separately from
+// leaseLost so that routine restarts don't look like failover events.
+func (s *RedisStore) releaseAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for channel, held := range s.leases {
+		if !held {
+			continue
+		}
+		key := s.leaseKey(channel)
+		if err := s.client.Del(key); err != nil {
+			logp.Err("checkpoint: failed to release redis lease for %v: %v", channel, err)
+			continue
+		}
+		s.leases[channel] = false
+		leaseHeldCount.Dec()
+		leaseReleased.Inc()
+	}
+}
+
+// HasLease reports whether this instance currently holds the harvesting
+// lease for channel. Callers should use this to decide whether to continue
+// reading from a Windows Event Log channel.
+func (s *RedisStore) HasLease(channel string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.leases[channel]
+}
+
+// Load returns all EventLogState persisted in Redis for this beat.
+func (s *RedisStore) Load() (map[string]EventLogState, error) {
+	states := make(map[string]EventLogState)
+
+	raw, err := s.client.HGetAll(s.hashKey())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load checkpoint state from redis: %v", err)
+	}
+
+	for name, value := range raw {
+		var state EventLogState
+		if err := json.Unmarshal([]byte(value), &state); err != nil {
+			return nil, fmt.Errorf("failed to decode checkpoint state for %v: %v", name, err)
+		}
+		states[name] = state
+	}
+	return states, nil
+}
+
+// Save persists a single EventLogState under this beat's Redis hash.
+func (s *RedisStore) Save(state EventLogState) error {
+	return s.Batch([]EventLogState{state})
+}
+
+// Batch writes all of the given states to the Redis hash.
+func (s *RedisStore) Batch(states []EventLogState) error {
+	for _, state := range states {
+		data, err := json.Marshal(state)
+		if err != nil {
+			return fmt.Errorf("failed to encode checkpoint state for %v: %v", state.Name, err)
+		}
+		if err := s.client.HSet(s.hashKey(), state.Name, string(data)); err != nil {
+			return fmt.Errorf("failed to persist checkpoint state for %v to redis: %v", state.Name, err)
+		}
+	}
+	return nil
+}
+
+// Close stops the lease goroutine, releases any held leases, and closes the
+// Redis connection.
+func (s *RedisStore) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		s.wg.Wait()
+	})
+	return s.client.Close()
+}
+
+// hashKey returns the Redis hash key that stores this beat's event log
+// state, e.g. "winlogbeat:checkpoint:<beat-id>".
+func (s *RedisStore) hashKey() string {
+	return s.keyPrefix
+}
+
+// leaseKey returns the Redis key used to coordinate harvesting of channel,
+// e.g. "winlogbeat:checkpoint:<beat-id>:<channel>:lease".
+func (s *RedisStore) leaseKey(channel string) string {
+	return fmt.Sprintf("%s:%s:lease", s.keyPrefix, channel)
+}
+
+func firstOrEmpty(addrs []string) string {
+	if len(addrs) == 0 {
+		return ""
+	}
+	return addrs[0]
+}
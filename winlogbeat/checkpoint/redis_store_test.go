@@ -0,0 +1,202 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedisClient is an in-memory redisClient test double. It models lease
+// keys (kv) and the per-beat hash of persisted EventLogState (hash)
+// separately, same as real Redis would via GET/SETNX/DEL and HGET/HSET.
+type fakeRedisClient struct {
+	mu   sync.Mutex
+	kv   map[string]string
+	hash map[string]string
+}
+
+func newFakeRedisClient() *fakeRedisClient {
+	return &fakeRedisClient{kv: make(map[string]string), hash: make(map[string]string)}
+}
+
+func (f *fakeRedisClient) Ping() error { return nil }
+
+func (f *fakeRedisClient) SetNX(key, value string, ttl time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, exists := f.kv[key]; exists {
+		return false, nil
+	}
+	f.kv[key] = value
+	return true, nil
+}
+
+func (f *fakeRedisClient) Del(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.kv, key)
+	return nil
+}
+
+func (f *fakeRedisClient) HGetAll(key string) (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make(map[string]string, len(f.hash))
+	for k, v := range f.hash {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (f *fakeRedisClient) HGet(key, field string) (string, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.hash[field]
+	return v, ok, nil
+}
+
+func (f *fakeRedisClient) HSet(key, field, value string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hash[field] = value
+	return nil
+}
+
+// Eval simulates the renew Lua script: it "extends" (returns 1) only if the
+// lease key's current owner still matches args[0], otherwise returns 0.
+func (f *fakeRedisClient) Eval(script string, keys []string, args ...interface{}) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	owner, _ := args[0].(string)
+	if f.kv[keys[0]] == owner {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (f *fakeRedisClient) Close() error { return nil }
+
+func (f *fakeRedisClient) setLeaseOwner(key, owner string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.kv[key] = owner
+}
+
+// newTestRedisStore builds a RedisStore around client without starting the
+// background run() goroutine, so tests can drive tick/tryAcquireOrRenew/
+// releaseAll deterministically.
+func newTestRedisStore(client redisClient, beatID string, channels []string) *RedisStore {
+	cfg := RedisConfig{
+		BeatID:        beatID,
+		LeaseTTL:      defaultLeaseTTL,
+		RenewInterval: defaultRenewInterval,
+		PollInterval:  defaultPollInterval,
+	}
+	s := &RedisStore{
+		client:    client,
+		cfg:       cfg,
+		keyPrefix: "winlogbeat:checkpoint:" + beatID,
+		done:      make(chan struct{}),
+		leases:    make(map[string]bool),
+		acquired:  make(chan EventLogState, len(channels)),
+	}
+	for _, channel := range channels {
+		s.leases[channel] = false
+	}
+	return s
+}
+
+func TestTickAcquiresFreeLease(t *testing.T) {
+	client := newFakeRedisClient()
+	store := newTestRedisStore(client, "beat-a", []string{"Application"})
+
+	store.tick(false)
+
+	assert.True(t, store.HasLease("Application"))
+	assert.Equal(t, "beat-a", client.kv[store.leaseKey("Application")])
+}
+
+func TestTickDoesNotStealHeldLease(t *testing.T) {
+	client := newFakeRedisClient()
+	client.setLeaseOwner("winlogbeat:checkpoint:beat-b:Application:lease", "beat-a")
+	store := newTestRedisStore(client, "beat-b", []string{"Application"})
+
+	store.tick(false)
+
+	assert.False(t, store.HasLease("Application"))
+}
+
+func TestRenewDetectsInvoluntaryLoss(t *testing.T) {
+	client := newFakeRedisClient()
+	store := newTestRedisStore(client, "beat-a", []string{"Application"})
+	store.leases["Application"] = true
+
+	// Simulate the lease expiring and another instance taking it over
+	// between this instance's renewal attempts.
+	client.setLeaseOwner(store.leaseKey("Application"), "beat-b")
+
+	lostBefore := leaseLost.Get()
+	heldCountBefore := leaseHeldCount.Get()
+
+	store.tick(true)
+
+	assert.False(t, store.HasLease("Application"))
+	assert.Equal(t, lostBefore+1, leaseLost.Get())
+	assert.Equal(t, heldCountBefore-1, leaseHeldCount.Get())
+}
+
+func TestReleaseAllUsesVoluntaryCounterNotLeaseLost(t *testing.T) {
+	client := newFakeRedisClient()
+	store := newTestRedisStore(client, "beat-a", []string{"Application"})
+	store.leases["Application"] = true
+	client.setLeaseOwner(store.leaseKey("Application"), "beat-a")
+
+	lostBefore := leaseLost.Get()
+	releasedBefore := leaseReleased.Get()
+
+	store.releaseAll()
+
+	assert.False(t, store.HasLease("Application"))
+	assert.Equal(t, lostBefore, leaseLost.Get(), "graceful release must not count as an involuntary loss")
+	assert.Equal(t, releasedBefore+1, leaseReleased.Get())
+	_, stillSet := client.kv[store.leaseKey("Application")]
+	assert.False(t, stillSet)
+}
+
+func TestAcquiringLeasePublishesPreviouslyPersistedState(t *testing.T) {
+	client := newFakeRedisClient()
+	store := newTestRedisStore(client, "beat-b", []string{"Application"})
+
+	previous := EventLogState{Name: "Application", RecordNumber: 55, Timestamp: time.Now().UTC()}
+	data, err := json.Marshal(previous)
+	require.NoError(t, err)
+	client.hash["Application"] = string(data)
+
+	store.tick(false)
+	require.True(t, store.HasLease("Application"))
+
+	select {
+	case got := <-store.Acquired():
+		assert.Equal(t, previous.RecordNumber, got.RecordNumber)
+	case <-time.After(time.Second):
+		t.Fatal("expected a state to be published on Acquired() after taking over the lease")
+	}
+}
+
+func TestAcquiringFreshLeaseWithNoPriorStatePublishesNothing(t *testing.T) {
+	client := newFakeRedisClient()
+	store := newTestRedisStore(client, "beat-a", []string{"Application"})
+
+	store.tick(false)
+	require.True(t, store.HasLease("Application"))
+
+	select {
+	case got := <-store.Acquired():
+		t.Fatalf("expected no acquired notification for a channel with no prior state, got %+v", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
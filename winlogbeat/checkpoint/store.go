@@ -0,0 +1,39 @@
+package checkpoint
+
+// Store is the persistence backend used by Checkpoint to load and save
+// EventLogState information. Implementations need not be safe for
+// concurrent use -- Checkpoint serializes all access to the Store from its
+// single worker goroutine.
+type Store interface {
+	// Load returns the event log state that was previously persisted, keyed
+	// by log name. It returns an empty map (not an error) if no state has
+	// been persisted yet.
+	Load() (map[string]EventLogState, error)
+
+	// Save persists a single EventLogState.
+	Save(state EventLogState) error
+
+	// Batch persists a set of EventLogState values as a single unit of
+	// work. Implementations that support transactions should apply the
+	// whole batch atomically.
+	Batch(states []EventLogState) error
+
+	// Close releases any resources held by the Store (open file handles,
+	// database handles, connections, etc.).
+	Close() error
+}
+
+// LeaseNotifier is implemented by Store backends that coordinate harvesting
+// of a log across multiple Checkpoint instances (see RedisStore). When such
+// a backend hands this instance the lease for a channel, it must publish
+// that channel's latest persisted EventLogState on Acquired so Checkpoint
+// can refresh its in-memory view. Without this, a standby that takes over a
+// lease would resume from whatever RecordNumber existed in its own state
+// when it started, rather than the value the previous owner last
+// persisted.
+type LeaseNotifier interface {
+	// Acquired returns a channel on which the Store publishes the latest
+	// persisted EventLogState for every channel this instance newly
+	// acquires the harvesting lease for.
+	Acquired() <-chan EventLogState
+}
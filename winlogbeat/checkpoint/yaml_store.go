@@ -0,0 +1,124 @@
+package checkpoint
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// YAMLStore is the default Store implementation. It persists all event log
+// state to a single YAML file, rewriting the file in full on every Save or
+// Batch call.
+type YAMLStore struct {
+	file string   // File where the state is persisted.
+	sort []string // Slice used for sorting states map (stored to save on mallocs).
+}
+
+// persistedState represents the format of the data persisted to disk.
+type persistedState struct {
+	UpdateTime time.Time       `yaml:"update_time"`
+	States     []EventLogState `yaml:"event_logs"`
+}
+
+// NewYAMLStore creates a Store that persists state to file as YAML.
+func NewYAMLStore(file string) (*YAMLStore, error) {
+	return &YAMLStore{
+		file: file,
+		sort: make([]string, 0, 10),
+	}, nil
+}
+
+// Load reads the persisted state from disk. If the file does not exist it
+// returns an empty map and no error.
+func (s *YAMLStore) Load() (map[string]EventLogState, error) {
+	states := make(map[string]EventLogState)
+
+	contents, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return states, nil
+		}
+		return nil, err
+	}
+
+	ps := &persistedState{}
+	if err = yaml.Unmarshal(contents, ps); err != nil {
+		return nil, err
+	}
+
+	for _, state := range ps.States {
+		states[state.Name] = state
+	}
+	return states, nil
+}
+
+// Save persists a single EventLogState by rewriting the whole file. This is
+// implemented in terms of Batch since the YAML file always stores the full
+// set of known states.
+func (s *YAMLStore) Save(state EventLogState) error {
+	return s.Batch([]EventLogState{state})
+}
+
+// Batch merges states into the on-disk file and rewrites it in full.
+func (s *YAMLStore) Batch(states []EventLogState) error {
+	existing, err := s.Load()
+	if err != nil {
+		return err
+	}
+
+	for _, state := range states {
+		existing[state.Name] = state
+	}
+
+	return s.flush(existing)
+}
+
+// Close is a no-op for YAMLStore since no resources are held between calls.
+func (s *YAMLStore) Close() error {
+	return nil
+}
+
+// flush writes the given states to disk, replacing the existing file.
+func (s *YAMLStore) flush(states map[string]EventLogState) error {
+	tempFile := s.file + ".new"
+	file, err := os.Create(tempFile)
+	if err != nil {
+		return fmt.Errorf("Failed to flush state to disk. Could not open %s. %v",
+			tempFile, err)
+	}
+
+	// Sort persisted eventLogs by name.
+	s.sort = s.sort[:0]
+	for k := range states {
+		s.sort = append(s.sort, k)
+	}
+	sort.Strings(s.sort)
+
+	ps := persistedState{
+		UpdateTime: time.Now().UTC(),
+		States:     make([]EventLogState, len(s.sort)),
+	}
+	for i, name := range s.sort {
+		ps.States[i] = states[name]
+	}
+
+	data, err := yaml.Marshal(ps)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Failed to flush state to disk. Could not marshal "+
+			"data to YAML. %v", err)
+	}
+
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("Failed to flush state to disk. Could not write to "+
+			"%s. %v", tempFile, err)
+	}
+
+	file.Close()
+	return os.Rename(tempFile, s.file)
+}